@@ -0,0 +1,109 @@
+// Package log provides the process-wide leveled logger used by both the
+// master and the worker. Callers log through the package-level
+// Debug/Info/Warn/Error/Crit functions, or bind contextual fields once
+// (e.g. proj_id, task_id) via WithFields and keep reusing the returned
+// Logger.
+package log
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelCrit
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelCrit:  "crit",
+}
+
+func parseLevel(s string) Level {
+	for lvl, name := range levelNames {
+		if name == strings.ToLower(s) {
+			return lvl
+		}
+	}
+	return LevelInfo
+}
+
+var logLevel = flag.String("log-level", "info", "Minimum log level to emit: debug, info, warn, error, crit")
+
+// Logger emits leveled, formatted log lines, optionally with a fixed set
+// of key/value fields prepended to every line it writes.
+type Logger interface {
+	Debug(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+	Crit(format string, args ...interface{})
+	// WithFields returns a Logger that also carries kv (alternating
+	// key, value, key, value, ...) on every line, in addition to any
+	// fields already bound on the receiver.
+	WithFields(kv ...interface{}) Logger
+}
+
+type fieldLogger struct {
+	fields []interface{}
+}
+
+func (l *fieldLogger) log(lvl Level, format string, args ...interface{}) {
+	if lvl < parseLevel(*logLevel) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if len(l.fields) > 0 {
+		parts := make([]string, 0, len(l.fields)/2)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			parts = append(parts, fmt.Sprintf("%v=%v", l.fields[i], l.fields[i+1]))
+		}
+		msg = fmt.Sprintf("%s %s", strings.Join(parts, " "), msg)
+	}
+	log.Printf("[%s] %s", levelNames[lvl], msg)
+}
+
+func (l *fieldLogger) Debug(format string, args ...interface{}) { l.log(LevelDebug, format, args...) }
+func (l *fieldLogger) Info(format string, args ...interface{})  { l.log(LevelInfo, format, args...) }
+func (l *fieldLogger) Warn(format string, args ...interface{})  { l.log(LevelWarn, format, args...) }
+func (l *fieldLogger) Error(format string, args ...interface{}) { l.log(LevelError, format, args...) }
+func (l *fieldLogger) Crit(format string, args ...interface{})  { l.log(LevelCrit, format, args...) }
+
+func (l *fieldLogger) WithFields(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &fieldLogger{fields: fields}
+}
+
+var base = &fieldLogger{}
+
+// WithFields returns a Logger bound with kv (alternating key, value,
+// ...), to be reused for every log line in some scope (a project, a
+// task, a tasklet).
+func WithFields(kv ...interface{}) Logger {
+	return base.WithFields(kv...)
+}
+
+func Debug(format string, args ...interface{}) { base.Debug(format, args...) }
+func Info(format string, args ...interface{})  { base.Info(format, args...) }
+func Warn(format string, args ...interface{})  { base.Warn(format, args...) }
+func Error(format string, args ...interface{}) { base.Error(format, args...) }
+func Crit(format string, args ...interface{})  { base.Crit(format, args...) }
+
+func init() {
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
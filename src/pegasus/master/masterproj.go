@@ -13,20 +13,50 @@ import (
 	"time"
 )
 
-var projctx = new(ProjectCtx)
+const (
+	// MAX_RUNNING_PROJECTS bounds how many projects the scheduler will run
+	// concurrently; submissions beyond this are queued in pendingProjs.
+	MAX_RUNNING_PROJECTS = 4
+	// MAX_PENDING_PROJECTS bounds the FIFO backlog of queued submissions.
+	MAX_PENDING_PROJECTS = 64
+	// PROJ_RETENTION bounds how long a finished project's ProjectCtx stays
+	// in the scheduler's tracked map, counted from the last status query
+	// of it (or from its submission if it was never queried), so its status
+	// can still be queried for a while without leaking memory forever.
+	PROJ_RETENTION      = 10 * time.Minute
+	PROJ_SWEEP_INTERVAL = 1 * time.Minute
+)
+
+type ProjState string
+
+const (
+	ProjStatePending  ProjState = "pending"
+	ProjStateRunning  ProjState = "running"
+	ProjStateFinished ProjState = "finished"
+)
+
+var sched = newScheduler()
 
 type ProjMeta struct {
 	Name     string
+	State    ProjState
 	StartTs  time.Time
 	EndTs    time.Time
 	err      error
 	ErrMsg   string
 	Finished bool
 	JobMetas []*JobMeta
+	// RunningJobKind is the kind of the job currently executing, or "" if
+	// none is (the project hasn't started, is between jobs, or has
+	// finished). JobMetas only gains an entry once a job returns, so
+	// without this a project's current job is invisible to a status query
+	// for as long as that job is running.
+	RunningJobKind string
 }
 
 func (pmeta *ProjMeta) init(projName string) *ProjMeta {
 	pmeta.Name = projName
+	pmeta.State = ProjStatePending
 	return pmeta
 }
 
@@ -40,50 +70,55 @@ func (pmeta *ProjMeta) snapshot() *ProjMeta {
 		metas[i] = jmeta
 	}
 	return &ProjMeta{
-		Name:     pmeta.Name,
-		StartTs:  pmeta.StartTs,
-		EndTs:    pmeta.EndTs,
-		ErrMsg:   pmeta.ErrMsg,
-		Finished: pmeta.Finished,
-		JobMetas: metas,
+		Name:           pmeta.Name,
+		State:          pmeta.State,
+		StartTs:        pmeta.StartTs,
+		EndTs:          pmeta.EndTs,
+		ErrMsg:         pmeta.ErrMsg,
+		Finished:       pmeta.Finished,
+		JobMetas:       metas,
+		RunningJobKind: pmeta.RunningJobKind,
 	}
 }
 
+// ProjectCtx tracks one submitted project through its lifetime. Unlike the
+// old single-slot tracker, the scheduler now keeps one of these per
+// concurrently tracked projId rather than reusing a single shared instance.
 type ProjectCtx struct {
-	idx int
+	projId string
+	logger log.Logger
 	// Following fields under mutex protection
-	mutex    sync.Mutex
-	free     bool
-	projId   string
-	config   string
-	proj     task.Project
-	projMeta *ProjMeta
+	mutex      sync.Mutex
+	config     string
+	proj       task.Project
+	projMeta   *ProjMeta
+	cancelCh   chan struct{}
+	cancelOnce sync.Once
+	// lastQueried is when queryProjStatusHandler last read this project's
+	// status, refreshed by touchQueried. sweep uses it, not projMeta.EndTs,
+	// to decide when a finished project's ProjectCtx can be dropped.
+	lastQueried time.Time
 }
 
-func (ctx *ProjectCtx) init() {
-	ctx.free = true
+func newProjectCtx(projId string, proj task.Project, config string) *ProjectCtx {
+	return &ProjectCtx{
+		projId:      projId,
+		logger:      log.WithFields("proj_id", projId),
+		proj:        proj,
+		config:      config,
+		projMeta:    new(ProjMeta).init(proj.GetName()),
+		cancelCh:    make(chan struct{}),
+		lastQueried: time.Now(),
+	}
 }
 
 func (ctx *ProjectCtx) start() {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	ctx.projMeta = new(ProjMeta).init(ctx.proj.GetName())
+	ctx.projMeta.State = ProjStateRunning
 	ctx.projMeta.StartTs = time.Now()
 }
 
-func (ctx *ProjectCtx) checkAndUnsetFree(proj task.Project, config string) (string, error) {
-	ctx.mutex.Lock()
-	defer ctx.mutex.Unlock()
-	if !ctx.free {
-		return "", fmt.Errorf("Project %q in running", ctx.projId)
-	}
-	ctx.free = false
-	ctx.proj = proj
-	ctx.config = config
-	ctx.projId = ctx.makeProjId()
-	return ctx.projId, nil
-}
-
 func (ctx *ProjectCtx) finish(err error) {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
@@ -91,16 +126,27 @@ func (ctx *ProjectCtx) finish(err error) {
 		ctx.projMeta.err = err
 		ctx.projMeta.ErrMsg = err.Error()
 	}
+	ctx.projMeta.State = ProjStateFinished
 	ctx.projMeta.Finished = true
 	ctx.projMeta.EndTs = time.Now()
-	ctx.free = true
 }
 
-func (ctx *ProjectCtx) makeProjId() string {
-	ts := time.Now().UnixNano()
-	pid := fmt.Sprintf("proj%d-%d", ts, ctx.idx)
-	ctx.idx++
-	return pid
+// cancel requests that the project stop before its next job starts.
+// Safe to call more than once (e.g. a retried cancel request) or
+// concurrently with the project finishing on its own.
+func (ctx *ProjectCtx) cancel() {
+	ctx.cancelOnce.Do(func() {
+		close(ctx.cancelCh)
+	})
+}
+
+func (ctx *ProjectCtx) cancelled() bool {
+	select {
+	case <-ctx.cancelCh:
+		return true
+	default:
+		return false
+	}
 }
 
 func (ctx *ProjectCtx) insertJobMeta(jmeta *JobMeta) {
@@ -109,41 +155,181 @@ func (ctx *ProjectCtx) insertJobMeta(jmeta *JobMeta) {
 	ctx.projMeta.insertJobMeta(jmeta)
 }
 
+// startJob records that kind is now the job running for this project, so
+// it's visible to a status query before it finishes and gains a JobMetas
+// entry. endJob clears it once the job returns, whether it succeeded or
+// not - reduceTasklets-style bookkeeping for the job itself happens via
+// insertJobMeta right after, in projRunner.
+func (ctx *ProjectCtx) startJob(kind string) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.projMeta.RunningJobKind = kind
+}
+
+func (ctx *ProjectCtx) endJob() {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.projMeta.RunningJobKind = ""
+}
+
 func (ctx *ProjectCtx) snapshotProjMeta() *ProjMeta {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	if ctx.projMeta == nil {
-		return nil
-	}
 	return ctx.projMeta.snapshot()
 }
 
-func projRunner() {
-	log.Info("Run project %q", projctx.projId)
-	projctx.start()
-	proj := projctx.proj
-	if err := proj.Init(projctx.config); err != nil {
-		projctx.finish(err)
-		log.Error("Fail on project %q init, %v", projctx.projId, err)
+// touchQueried refreshes lastQueried to now. Called only from a
+// client-facing status query, not from sweep's own internal pass, so
+// retention is actually measured against "last queried" rather than
+// resetting itself every sweep tick.
+func (ctx *ProjectCtx) touchQueried() {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.lastQueried = time.Now()
+}
+
+func (ctx *ProjectCtx) getLastQueried() time.Time {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.lastQueried
+}
+
+// scheduler accepts project submissions, running up to MAX_RUNNING_PROJECTS
+// of them concurrently and enqueuing overflow in a bounded FIFO rather than
+// rejecting it outright.
+type scheduler struct {
+	mutex   sync.Mutex
+	idx     int
+	running int
+	tracked map[string]*ProjectCtx
+	pending []*ProjectCtx
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		tracked: make(map[string]*ProjectCtx),
+	}
+}
+
+func (s *scheduler) makeProjId() string {
+	ts := time.Now().UnixNano()
+	pid := fmt.Sprintf("proj%d-%d", ts, s.idx)
+	s.idx++
+	return pid
+}
+
+// submit registers a new project and either starts it immediately or, if
+// the scheduler is already at capacity, enqueues it to run once a slot
+// frees up.
+func (s *scheduler) submit(proj task.Project, config string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running >= MAX_RUNNING_PROJECTS && len(s.pending) >= MAX_PENDING_PROJECTS {
+		return "", fmt.Errorf("Scheduler queue full, reject project %q", proj.GetName())
+	}
+	projId := s.makeProjId()
+	ctx := newProjectCtx(projId, proj, config)
+	s.tracked[projId] = ctx
+	if s.running < MAX_RUNNING_PROJECTS {
+		s.running++
+		go s.runProject(ctx)
+	} else {
+		s.pending = append(s.pending, ctx)
+	}
+	return projId, nil
+}
+
+func (s *scheduler) runProject(ctx *ProjectCtx) {
+	projRunner(ctx)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running--
+	s.dequeueLocked()
+}
+
+// dequeueLocked starts the next pending project, if any. Caller must hold
+// s.mutex.
+func (s *scheduler) dequeueLocked() {
+	if len(s.pending) == 0 || s.running >= MAX_RUNNING_PROJECTS {
+		return
+	}
+	ctx := s.pending[0]
+	s.pending = s.pending[1:]
+	s.running++
+	go s.runProject(ctx)
+}
+
+func (s *scheduler) get(projId string) *ProjectCtx {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tracked[projId]
+}
+
+// sweep evicts finished projects whose ProjMeta hasn't been queried in
+// PROJ_RETENTION, mirroring the worker's resultStore sweeper.
+func (s *scheduler) sweep() {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for projId, ctx := range s.tracked {
+		pmeta := ctx.snapshotProjMeta()
+		if pmeta.Finished && now.Sub(ctx.getLastQueried()) > PROJ_RETENTION {
+			delete(s.tracked, projId)
+		}
+	}
+}
+
+func (s *scheduler) sweepLoop() {
+	for range time.Tick(PROJ_SWEEP_INTERVAL) {
+		s.sweep()
+	}
+}
+
+func (s *scheduler) list() map[string]*ProjMeta {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metas := make(map[string]*ProjMeta, len(s.tracked))
+	for projId, ctx := range s.tracked {
+		metas[projId] = ctx.snapshotProjMeta()
+	}
+	return metas
+}
+
+func projRunner(ctx *ProjectCtx) {
+	ctx.logger.Info("Run project")
+	ctx.start()
+	proj := ctx.proj
+	if err := proj.Init(ctx.config); err != nil {
+		ctx.finish(err)
+		ctx.logger.Error("Fail on project init, %v", err)
 		return
 	}
 	for _, job := range proj.GetJobs() {
+		jobLogger := ctx.logger.WithFields("job_kind", job.GetKind())
+		if ctx.cancelled() {
+			err := fmt.Errorf("Project %q cancelled", ctx.projId)
+			ctx.finish(err)
+			jobLogger.Info(err.Error())
+			return
+		}
+		ctx.startJob(job.GetKind())
 		jmeta, err := runJob(job, proj.GetEnv())
-		projctx.insertJobMeta(jmeta)
+		ctx.endJob()
+		ctx.insertJobMeta(jmeta)
 		if err != nil {
 			err = fmt.Errorf("Fail on job %q, %v", job.GetKind(), err)
-			projctx.finish(err)
-			log.Error(err.Error())
-			break
+			ctx.finish(err)
+			jobLogger.Error(err.Error())
+			return
 		}
 	}
 	if err := proj.Finish(); err != nil {
-		projctx.finish(err)
-		log.Error("Fail on project %q finish, %v", projctx.projId, err)
+		ctx.finish(err)
+		ctx.logger.Error("Fail on project finish, %v", err)
 		return
 	}
-	projctx.finish(nil)
-	log.Info("Run project %q finished", projctx.projId)
+	ctx.finish(nil)
+	ctx.logger.Info("Run project finished")
 }
 
 type RunProjReceipt struct {
@@ -152,14 +338,10 @@ type RunProjReceipt struct {
 }
 
 func runProj(proj task.Project, config string) *RunProjReceipt {
-	projId, err := projctx.checkAndUnsetFree(proj, config)
+	projId, err := sched.submit(proj, config)
 	if err != nil {
-		return &RunProjReceipt{
-			ErrMsg: err.Error(),
-			ProjId: projId,
-		}
+		return &RunProjReceipt{ErrMsg: err.Error()}
 	}
-	go projRunner()
 	return &RunProjReceipt{ProjId: projId}
 }
 
@@ -188,22 +370,47 @@ func runProjHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func queryProjStatusHandler(w http.ResponseWriter, r *http.Request) {
-	pmeta := projctx.snapshotProjMeta()
-	jmeta := jobctx.snapshotJobMeta()
-	jmetas := pmeta.JobMetas
-	if jmeta.Kind == "" {
-		// do nothing
-	} else if len(jmetas) > 0 {
-		last := jmetas[len(jmetas)-1]
-		if last.Kind != jmeta.Kind && last.StartTs != jmeta.StartTs {
-			pmeta.JobMetas = append(pmeta.JobMetas, jmeta)
-		}
-	} else {
-		pmeta.JobMetas = append(pmeta.JobMetas, jmeta)
+	if err := r.ParseForm(); err != nil {
+		err = fmt.Errorf("Fail to parse form, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
 	}
+	projId := r.Form.Get(uri.MasterProjIdKey)
+	ctx := sched.get(projId)
+	if ctx == nil {
+		err := fmt.Errorf("Proj %q not found", projId)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	ctx.touchQueried()
+	pmeta := ctx.snapshotProjMeta()
 	server.FmtResp(w, nil, pmeta)
 }
 
+// cancelProjHandler requests that a submitted project stop before its
+// next job starts. Already-finished or already-cancelled projects accept
+// this as a no-op rather than an error.
+func cancelProjHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		err = fmt.Errorf("Fail to parse form, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	projId := r.Form.Get(uri.MasterProjIdKey)
+	ctx := sched.get(projId)
+	if ctx == nil {
+		err := fmt.Errorf("Proj %q not found", projId)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	ctx.cancel()
+	server.FmtResp(w, nil, nil)
+}
+
+func listProjsHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, sched.list())
+}
+
 func init() {
-	projctx.init()
+	go sched.sweepLoop()
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/util"
+	"sync"
+)
+
+// TaskletFailedMsg mirrors the payload a worker posts when one of its
+// tasklets fails under the "continue" failure policy.
+type TaskletFailedMsg struct {
+	TaskId    string
+	TaskletId string
+	Attempts  int
+	Err       string
+}
+
+// taskletFailureTracker keeps per-task tasklet failures reported by
+// workers, so the master can see which tasklets need reassignment instead
+// of only learning about a whole task's outcome from the final report.
+type taskletFailureTracker struct {
+	mutex  sync.Mutex
+	failed map[string][]*TaskletFailedMsg
+}
+
+var taskletFailures = &taskletFailureTracker{failed: make(map[string][]*TaskletFailedMsg)}
+
+func (t *taskletFailureTracker) record(msg *TaskletFailedMsg) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.failed[msg.TaskId] = append(t.failed[msg.TaskId], msg)
+}
+
+func (t *taskletFailureTracker) get(taskId string) []*TaskletFailedMsg {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.failed[taskId]
+}
+
+func taskletFailedHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := util.HttpReadRequestJsonBody(r)
+	if err != nil {
+		err = fmt.Errorf("Fail to read body, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	msg := new(TaskletFailedMsg)
+	if err = json.Unmarshal(body, msg); err != nil {
+		err = fmt.Errorf("Fail to unmarshal tasklet failed msg, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	log.Error("Tasklet %q of task %q failed after %d attempts, %s", msg.TaskletId, msg.TaskId, msg.Attempts, msg.Err)
+	taskletFailures.record(msg)
+	server.FmtResp(w, nil, nil)
+}
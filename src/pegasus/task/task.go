@@ -0,0 +1,146 @@
+// Package task defines the shapes shared between the master and the
+// worker: what a project/task/tasklet looks like, and the specs/reports
+// that cross the wire between them.
+package task
+
+import (
+	"context"
+	"time"
+)
+
+// Job is one step of a Project's pipeline.
+type Job interface {
+	GetKind() string
+}
+
+// Env carries whatever a Project wants its jobs to see; jobs interpret it
+// according to their own kind.
+type Env interface{}
+
+// Project is a named pipeline of jobs submitted to the master.
+type Project interface {
+	GetName() string
+	Init(config string) error
+	GetJobs() []Job
+	GetEnv() Env
+	Finish() error
+}
+
+// FailurePolicy selects how a worker handles a tasklet that exhausts its
+// retries: "abort" fails the whole task on the first such tasklet (the
+// default), "continue" reports it to the master and keeps going.
+type FailurePolicy string
+
+const (
+	FailurePolicyAbort    FailurePolicy = "abort"
+	FailurePolicyContinue FailurePolicy = "continue"
+)
+
+// TaskletFailure records one tasklet that exhausted its retries under the
+// "continue" failure policy.
+type TaskletFailure struct {
+	TaskletId string
+	Attempts  int
+	Err       string
+}
+
+// TaskSpec is what the master posts to a worker to hand off a task.
+type TaskSpec struct {
+	Tid  string
+	Kind string
+	// Retention is how long the worker keeps a finished task's TaskReport
+	// available via /task/result after posting it to the master. Zero
+	// means the worker's own default applies.
+	Retention     time.Duration
+	FailurePolicy FailurePolicy
+}
+
+// ResourceLimits bounds what a single tasklet executor is allowed to
+// consume. A zero value means "no limit" for that dimension. TimeoutMs is
+// enforced on every platform; CPUTimeMs and Pids are enforced only on
+// Linux, through the attempt's cgroup. MemoryMB is not enforced at all
+// (see newTaskletCgroup in the worker).
+type ResourceLimits struct {
+	CPUTimeMs int64
+	MemoryMB  int64
+	Pids      int64
+	TimeoutMs int64
+}
+
+// Timeout returns the wall-clock deadline for one tasklet execution, or 0
+// if none is configured. Callers must treat 0 as "no deadline" rather
+// than an already-expired one.
+func (r ResourceLimits) Timeout() time.Duration {
+	return time.Duration(r.TimeoutMs) * time.Millisecond
+}
+
+// TaskletMetrics captures the actual resource usage of one tasklet
+// execution, gathered from the per-attempt cgroup (on Linux) or from
+// wall-clock timing alone on platforms without cgroup support.
+type TaskletMetrics struct {
+	PeakRSSBytes    int64
+	CPUTimeMs       int64
+	WallTimeMs      int64
+	OOMKilled       bool
+	TimedOut        bool
+	CPUTimeExceeded bool
+}
+
+// TaskStatus is a point-in-time snapshot of a running (or just-finished)
+// task, polled by the master.
+type TaskStatus struct {
+	Tid            string
+	Desc           string
+	StartTs        time.Time
+	Finished       bool
+	Total          int
+	Done           int
+	TaskletMetrics map[string]*TaskletMetrics
+}
+
+// TaskReport is what a worker posts back to the master once a task
+// finishes.
+type TaskReport struct {
+	Err            string
+	Tid            string
+	Kind           string
+	StartTs        time.Time
+	EndTs          time.Time
+	Status         *TaskStatus
+	Output         interface{}
+	FailedTasklets []TaskletFailure
+}
+
+// TaskletCtx is handed to a Tasklet's Execute call; it exposes the
+// deadline the executor is enforcing and a way for the executor to kill
+// the tasklet's child processes on timeout.
+type TaskletCtx interface {
+	Close()
+	SetContext(ctx context.Context)
+	Kill()
+}
+
+// Tasklet is one unit of work within a Task.
+type Tasklet interface {
+	GetTaskletId() string
+	Execute(ctx TaskletCtx) error
+}
+
+// Task is one unit of work submitted to a worker. A worker calls
+// GetNextTasklet until it returns nil and queues each tasklet for a pool
+// of tasklet executors, which run them concurrently.
+type Task interface {
+	GetTaskId() string
+	GetKind() string
+	GetDesc() string
+	Init(executorCnt int) error
+	GetTaskletCnt() int
+	SuggestedParallelism() int
+	GetResourceLimits() ResourceLimits
+	NewTaskletCtx() TaskletCtx
+	GetNextTasklet(taskletId string) Tasklet
+	ReduceTasklets(tasklets []Tasklet, failed []TaskletFailure)
+	SetError(err error)
+	GetError() error
+	GetOutput() interface{}
+}
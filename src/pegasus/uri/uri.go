@@ -0,0 +1,23 @@
+// Package uri collects the HTTP paths and form/query keys shared between
+// the master and worker, so neither side hardcodes the other's routes.
+package uri
+
+const (
+	// MasterProjNameKey is the form key a project submission carries the
+	// registered project name under.
+	MasterProjNameKey = "proj_name"
+	// MasterProjIdKey is the query key used to look up a submitted
+	// project's status by the id returned from submission.
+	MasterProjIdKey = "proj_id"
+
+	// MasterWorkerTaskReportUri is where a worker posts a TaskReport once
+	// a task finishes.
+	MasterWorkerTaskReportUri = "/master/worker/task_report"
+	// MasterWorkerTaskStatusUri is where a worker posts in-progress
+	// TaskStatus updates for a running task.
+	MasterWorkerTaskStatusUri = "/master/worker/task_status"
+	// MasterWorkerTaskletFailedUri is where a worker reports a single
+	// tasklet failure under the "continue" FailurePolicy, separately from
+	// the final TaskReport.
+	MasterWorkerTaskletFailedUri = "/master/worker/tasklet_failed"
+)
@@ -0,0 +1,186 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/task"
+	"strconv"
+	"strings"
+)
+
+// CGROUP_PARENT_PATH is the cgroup v2 subtree under which this worker
+// creates one cgroup per tasklet execution attempt. Configurable so a
+// deployment can point it at a delegated slice rather than the root.
+var CGROUP_PARENT_PATH = "/sys/fs/cgroup/pegasus"
+
+type taskletCgroup struct {
+	path string
+	// addedPid is the pid last written to this cgroup's cgroup.procs, or 0
+	// if none was ever added. Tracked so close() can evict it back to
+	// CGROUP_PARENT_PATH before removing path - otherwise the directory
+	// stays a non-empty cgroup forever and os.Remove fails EBUSY.
+	addedPid int
+	// cpuBudgetUsec is the total CPU time (in microseconds) this tasklet
+	// execution is allowed to consume over its whole run, or 0 for no
+	// limit. Unlike pids.max, cgroup v2 has no native "total budget" knob
+	// - cpu.max only expresses a recurring rate quota - so this is
+	// enforced by polling cpu.stat and killing the tasklet once it's
+	// exceeded, rather than by writing cpu.max.
+	cpuBudgetUsec int64
+}
+
+// newTaskletCgroup creates a fresh cgroup v2 subtree for one tasklet
+// execution attempt and applies the given resource limits before any
+// process is added to it. Each attempt gets its own cgroup (named by
+// executorId and the caller-supplied seq) rather than one shared per
+// executor, so memory.peak/cpu.stat - which are cumulative since the
+// cgroup's creation - reflect this one attempt instead of accumulating
+// across every tasklet an executor has ever run.
+//
+// limits.MemoryMB is intentionally not enforced here: tasklets run as
+// goroutines of the worker process rather than as their own subprocess,
+// so the only pid this cgroup can ever contain is the whole worker's.
+// Writing memory.max would let one tasklet's memory limit OOM-kill the
+// entire worker, not just that tasklet, so memory limiting is left to a
+// future worker that actually execs tasklets as child processes.
+func newTaskletCgroup(parent string, executorId, seq int, limits task.ResourceLimits) (*taskletCgroup, error) {
+	path := filepath.Join(parent, fmt.Sprintf("executor-%d-%d", executorId, seq))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("Fail to create cgroup %q, %v", path, err)
+	}
+	cg := &taskletCgroup{path: path}
+	if limits.CPUTimeMs > 0 {
+		// CPUTimeMs is a total CPU-time budget for the whole tasklet, not a
+		// recurring rate, so it can't be expressed as cpu.max (which caps
+		// usage per period, e.g. "N usec per 100ms" forever). Track the
+		// budget and enforce it by polling cpu.stat instead; see
+		// cpuBudgetExceeded.
+		cg.cpuBudgetUsec = limits.CPUTimeMs * 1000
+	}
+	if limits.Pids > 0 {
+		if err := cg.writeFile("pids.max", fmt.Sprintf("%d", limits.Pids)); err != nil {
+			return cg, err
+		}
+	}
+	return cg, nil
+}
+
+func (cg *taskletCgroup) writeFile(name, val string) error {
+	p := filepath.Join(cg.path, name)
+	if err := os.WriteFile(p, []byte(val), 0644); err != nil {
+		return fmt.Errorf("Fail to write %q, %v", p, err)
+	}
+	return nil
+}
+
+// addProcess moves pid into this cgroup so the metrics read back in
+// readMetrics are real instead of measuring an empty cgroup. Tasklets run
+// as goroutines of the worker process rather than as their own
+// subprocess, so this moves the whole worker process in for the duration
+// of the tasklet; a second executor doing the same concurrently will pull
+// the same pid into its own cgroup instead; a process lives in exactly one
+// cgroup at a time, so concurrent attempts' cpu.stat readings will blend
+// together. That's an accepted limitation of accounting a goroutine-based
+// execution model through a process-scoped cgroup; see newTaskletCgroup for why
+// memory.max is never written here, which is what would have made that
+// limitation dangerous rather than just imprecise.
+func (cg *taskletCgroup) addProcess(pid int) error {
+	if err := cg.writeFile("cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+	cg.addedPid = pid
+	return nil
+}
+
+// cpuBudgetExceeded reports whether the cgroup's total CPU usage so far
+// has exceeded cpuBudgetUsec. Callers poll this while a tasklet runs,
+// since cpu.max can't express a cumulative cap (see newTaskletCgroup).
+func (cg *taskletCgroup) cpuBudgetExceeded() (bool, error) {
+	if cg.cpuBudgetUsec <= 0 {
+		return false, nil
+	}
+	usec, err := cg.readCpuStatUsec()
+	if err != nil {
+		return false, err
+	}
+	return usec >= cg.cpuBudgetUsec, nil
+}
+
+// readMetrics reads back the accounting files populated since the cgroup
+// was created. Called once per tasklet execution attempt, after the
+// attempt's Execute call returns or the attempt is killed.
+func (cg *taskletCgroup) readMetrics() (*cgroupMetrics, error) {
+	m := &cgroupMetrics{}
+	if peak, err := cg.readInt("memory.peak"); err == nil {
+		m.PeakRSSBytes = peak
+	}
+	if cpu, err := cg.readCpuStatUsec(); err == nil {
+		m.CPUTimeMs = cpu / 1000
+	}
+	if oom, err := cg.readOomKillCount(); err == nil {
+		m.OOMKilled = oom > 0
+	}
+	return m, nil
+}
+
+func (cg *taskletCgroup) readInt(name string) (int64, error) {
+	buf, err := os.ReadFile(filepath.Join(cg.path, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+func (cg *taskletCgroup) readCpuStatUsec() (int64, error) {
+	f, err := os.Open(filepath.Join(cg.path, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("usage_usec not found in cpu.stat")
+}
+
+func (cg *taskletCgroup) readOomKillCount() (int64, error) {
+	f, err := os.Open(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("oom_kill not found in memory.events")
+}
+
+// close evicts this cgroup's tracked pid (if any) back to
+// CGROUP_PARENT_PATH and removes the now-empty directory. Removal must
+// happen with cgroup.procs empty - a cgroup still holding the worker's pid
+// fails os.Remove with EBUSY forever, since nothing else ever takes that
+// pid back out.
+func (cg *taskletCgroup) close() {
+	if cg.addedPid != 0 {
+		parentProcs := filepath.Join(CGROUP_PARENT_PATH, "cgroup.procs")
+		if err := os.WriteFile(parentProcs, []byte(strconv.Itoa(cg.addedPid)), 0644); err != nil {
+			log.Error("Fail to evict pid %d from cgroup %q, %v", cg.addedPid, cg.path, err)
+		}
+	}
+	if err := os.Remove(cg.path); err != nil {
+		log.Error("Fail to remove cgroup %q, %v", cg.path, err)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package main
+
+import "pegasus/task"
+
+// CGROUP_PARENT_PATH is unused outside Linux; kept so callers don't need a
+// build-tagged reference to it.
+var CGROUP_PARENT_PATH = ""
+
+// taskletCgroup is a no-op stand-in on platforms without cgroup v2.
+// Resource limits are not enforced and only wall-clock timeout applies.
+type taskletCgroup struct {
+	cpuBudgetUsec int64
+}
+
+func newTaskletCgroup(parent string, executorId, seq int, limits task.ResourceLimits) (*taskletCgroup, error) {
+	return nil, nil
+}
+
+func (cg *taskletCgroup) addProcess(pid int) error {
+	return nil
+}
+
+func (cg *taskletCgroup) readMetrics() (*cgroupMetrics, error) {
+	return &cgroupMetrics{}, nil
+}
+
+func (cg *taskletCgroup) cpuBudgetExceeded() (bool, error) {
+	return false, nil
+}
+
+func (cg *taskletCgroup) close() {}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"pegasus/server"
+	"runtime"
+	"strconv"
+)
+
+var (
+	minExecutors = flag.Int("min-executors", 1, "Minimum tasklet executors to run per task")
+	maxExecutors = flag.Int("max-executors", runtime.NumCPU(), "Maximum tasklet executors to run per task")
+)
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+type ScaleReceipt struct {
+	ErrMsg string
+	Count  int
+}
+
+// scaleWorkerHandler lets an operator grow or shrink the executor pool for
+// whatever task the worker is currently running, without restarting it.
+func scaleWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		err = fmt.Errorf("Fail to parse form, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	count, err := strconv.Atoi(r.Form.Get("count"))
+	if err != nil {
+		err = fmt.Errorf("Bad count param, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	count = clamp(count, *minExecutors, *maxExecutors)
+	tsk, ok := tskctx.currentTask()
+	if !ok {
+		err = fmt.Errorf("No task running, nothing to scale")
+		server.FmtResp(w, err, nil)
+		return
+	}
+	tskctx.scale(tsk, count)
+	server.FmtResp(w, nil, &ScaleReceipt{Count: count})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/task"
+	"pegasus/uri"
+	"pegasus/util"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_FILE_PATH      = "worker_report_spool.jsonl"
+	SPOOL_DRAIN_TICK     = 1 * time.Second
+	SPOOL_BACKOFF_BASE   = 1 * time.Second
+	SPOOL_BACKOFF_CAP    = 5 * time.Minute
+	SPOOL_MAX_ATTEMPTS   = 10
+	SPOOL_BACKOFF_FACTOR = 2
+)
+
+// spoolEntry is one undelivered task report, persisted to SPOOL_FILE_PATH
+// so it survives a worker restart.
+type spoolEntry struct {
+	Report    *task.TaskReport
+	Attempts  int
+	NextRetry time.Time
+}
+
+// reportSpool durably queues task reports that failed to POST to the
+// master and retries them with exponential backoff, so a brief master
+// outage doesn't silently drop results.
+type reportSpool struct {
+	mutex       sync.Mutex
+	path        string
+	maxAttempts int
+	pending     map[string]*spoolEntry
+}
+
+var spool = newReportSpool(SPOOL_FILE_PATH, SPOOL_MAX_ATTEMPTS)
+
+func newReportSpool(path string, maxAttempts int) *reportSpool {
+	return &reportSpool{
+		path:        path,
+		maxAttempts: maxAttempts,
+		pending:     make(map[string]*spoolEntry),
+	}
+}
+
+func (s *reportSpool) enqueue(report *task.TaskReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending[report.Tid] = &spoolEntry{
+		Report:    report,
+		NextRetry: time.Now(),
+	}
+	s.persistLocked()
+}
+
+func (s *reportSpool) remove(tid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pending, tid)
+	s.persistLocked()
+}
+
+func (s *reportSpool) bump(tid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.pending[tid]
+	if !ok {
+		return
+	}
+	e.Attempts++
+	if e.Attempts >= s.maxAttempts {
+		log.Error("Give up on spooled report %q after %d attempts", tid, e.Attempts)
+		delete(s.pending, tid)
+	} else {
+		backoff := SPOOL_BACKOFF_BASE * time.Duration(pow(SPOOL_BACKOFF_FACTOR, e.Attempts-1))
+		if backoff > SPOOL_BACKOFF_CAP {
+			backoff = SPOOL_BACKOFF_CAP
+		}
+		backoff += time.Duration(rand.Int63n(int64(backoff)/4 + 1))
+		e.NextRetry = time.Now().Add(backoff)
+	}
+	s.persistLocked()
+}
+
+func pow(base, exp int) int {
+	r := 1
+	for i := 0; i < exp; i++ {
+		r *= base
+	}
+	return r
+}
+
+// persistLocked rewrites the spool file from the in-memory set. Caller
+// must hold s.mutex. Volume is expected to stay low (failed reports are
+// the exception, not the norm), so a full rewrite per change is simplest.
+// It writes to a temp file in the same directory, fsyncs it, then renames
+// it over s.path, so a crash mid-rewrite can't leave a truncated or
+// partially-written spool behind.
+func (s *reportSpool) persistLocked() {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		log.Error("Fail to persist report spool %q, %v", s.path, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for _, e := range s.pending {
+		if err := enc.Encode(e); err != nil {
+			log.Error("Fail to encode spooled report %q, %v", e.Report.Tid, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		log.Error("Fail to sync report spool %q, %v", s.path, err)
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		log.Error("Fail to close report spool tmp file %q, %v", tmp.Name(), err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		log.Error("Fail to persist report spool %q, %v", s.path, err)
+	}
+}
+
+// replay loads any reports left over from a previous run and makes them
+// immediately due. It runs from init, before the worker serves any
+// request; the loaded reports are then retried by drainLoop on its next
+// tick, which does not hold back new tasks.
+func (s *reportSpool) replay() {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Fail to open report spool %q, %v", s.path, err)
+		}
+		return
+	}
+	defer f.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Error("Fail to parse spooled report, %v", err)
+			continue
+		}
+		e.NextRetry = time.Now()
+		s.pending[e.Report.Tid] = &e
+	}
+	log.Info("Replayed %d spooled report(s) from %q", len(s.pending), s.path)
+}
+
+func (s *reportSpool) due() []*spoolEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	due := make([]*spoolEntry, 0)
+	for _, e := range s.pending {
+		if !now.Before(e.NextRetry) {
+			due = append(due, e)
+		}
+	}
+	return due
+}
+
+func (s *reportSpool) snapshot() []*spoolEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := make([]*spoolEntry, 0, len(s.pending))
+	for _, e := range s.pending {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (s *reportSpool) drainLoop() {
+	for range time.Tick(SPOOL_DRAIN_TICK) {
+		for _, e := range s.due() {
+			if err := postTaskReport(e.Report); err != nil {
+				log.Error("Retry send spooled report %q failed, %v", e.Report.Tid, err)
+				s.bump(e.Report.Tid)
+				continue
+			}
+			log.Info("Spooled report %q delivered", e.Report.Tid)
+			s.remove(e.Report.Tid)
+		}
+	}
+}
+
+func postTaskReport(report *task.TaskReport) error {
+	u := workerSelf.makeMasterUrl(uri.MasterWorkerTaskReportUri)
+	_, err := util.HttpPostData(u, report)
+	return err
+}
+
+func pendingReportsHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, spool.snapshot())
+}
+
+func init() {
+	spool.replay()
+	go spool.drainLoop()
+}
@@ -0,0 +1,19 @@
+package main
+
+// cgroupMetrics is the subset of task.TaskletMetrics that comes from
+// reading back cgroup accounting files after a tasklet finishes.
+type cgroupMetrics struct {
+	PeakRSSBytes int64
+	CPUTimeMs    int64
+	OOMKilled    bool
+}
+
+// TaskletFailedMsg is the wire payload posted to
+// uri.MasterWorkerTaskletFailedUri when a tasklet fails under the
+// "continue" failure policy.
+type TaskletFailedMsg struct {
+	TaskId    string
+	TaskletId string
+	Attempts  int
+	Err       string
+}
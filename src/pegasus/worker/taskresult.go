@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/task"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_RESULT_RETENTION is used when a TaskSpec doesn't set one.
+	DEFAULT_RESULT_RETENTION = 10 * time.Minute
+	RESULT_SWEEP_INTERVAL    = 1 * time.Minute
+)
+
+type retainedResult struct {
+	report  *task.TaskReport
+	expires time.Time
+}
+
+// resultStore retains completed task reports for a configurable window so
+// the master (or an operator) can re-fetch a result after a transient
+// failure delivering it via sendTaskReport.
+type resultStore struct {
+	mutex   sync.Mutex
+	results map[string]*retainedResult
+}
+
+var results = newResultStore()
+
+func newResultStore() *resultStore {
+	return &resultStore{results: make(map[string]*retainedResult)}
+}
+
+func (s *resultStore) put(report *task.TaskReport, retention time.Duration) {
+	if retention <= 0 {
+		retention = DEFAULT_RESULT_RETENTION
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[report.Tid] = &retainedResult{
+		report:  report,
+		expires: time.Now().Add(retention),
+	}
+}
+
+func (s *resultStore) get(tid string) *task.TaskReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, ok := s.results[tid]
+	if !ok {
+		return nil
+	}
+	return r.report
+}
+
+func (s *resultStore) sweep() {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for tid, r := range s.results {
+		if now.After(r.expires) {
+			delete(s.results, tid)
+		}
+	}
+}
+
+func (s *resultStore) sweepLoop() {
+	for range time.Tick(RESULT_SWEEP_INTERVAL) {
+		s.sweep()
+	}
+}
+
+func taskResultHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		err = fmt.Errorf("Fail to parse form, err %v", err)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	tid := r.Form.Get("tid")
+	report := results.get(tid)
+	if report == nil {
+		err := fmt.Errorf("Result for task %q not found", tid)
+		server.FmtResp(w, err, nil)
+		return
+	}
+	server.FmtResp(w, nil, report)
+}
+
+func init() {
+	log.Info("Start task result sweeper, retention %v", DEFAULT_RESULT_RETENTION)
+	go results.sweepLoop()
+}
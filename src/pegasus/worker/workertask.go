@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"pegasus/log"
 	"pegasus/server"
 	"pegasus/task"
@@ -17,16 +19,16 @@ import (
 var tskctx = &TaskCtx{}
 
 const (
-	BUF_TASKLET_CNT = 8
-	// TODO test purpose
-	//RUNNING_EXECUTOR_CNT = 4
-	RUNNING_EXECUTOR_CNT = 2
-	TASKLET_MAX_RETRY    = 3
+	BUF_TASKLET_CNT          = 8
+	TASKLET_MAX_RETRY        = 3
+	CPU_BUDGET_POLL_INTERVAL = 100 * time.Millisecond
 )
 
 type TaskCtx struct {
 	tsk            task.Task
-	wgFinish       sync.WaitGroup
+	logger         log.Logger
+	retention      time.Duration
+	failurePolicy  task.FailurePolicy
 	taskletCtxList []task.TaskletCtx
 	todoTasklets   chan task.Tasklet
 	doneTasklets   chan task.Tasklet
@@ -39,6 +41,146 @@ type TaskCtx struct {
 	finished bool
 	startTs  time.Time
 	endTs    time.Time
+	metrics  map[string]*task.TaskletMetrics
+	failed   []task.TaskletFailure
+
+	// liveExecutors counts running taskletExecutor goroutines. accepting
+	// is true from init() until the last executor exits on its own
+	// (liveExecutors reaching 0), at which point allDone is closed. Both
+	// are flipped together under mutex so a scale-up can never register a
+	// new executor after the task has already moved on to reduceTasklets,
+	// and a scale-up can never land in the same instant allDone is closed
+	// out from under it - the two outcomes are mutually exclusive because
+	// they're decided by the same lock.
+	liveExecutors int
+	accepting     bool
+	allDone       chan struct{}
+	executorIdSeq int
+	drainCh       chan struct{}
+}
+
+// registerExecutor admits one more running executor, unless the task has
+// already stopped accepting them (all originally spawned executors have
+// already exited). Every call that intends to start a taskletExecutor
+// goroutine must succeed here first, immediately before starting it.
+func (ctx *TaskCtx) registerExecutor() bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if !ctx.accepting {
+		return false
+	}
+	ctx.liveExecutors++
+	return true
+}
+
+// deregisterExecutor records one executor's exit. If it was the last one
+// still running, the task stops accepting further scale-ups and signals
+// waitForTaskDone via allDone.
+func (ctx *TaskCtx) deregisterExecutor() {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.liveExecutors--
+	if ctx.liveExecutors == 0 {
+		ctx.accepting = false
+		close(ctx.allDone)
+	}
+}
+
+func (ctx *TaskCtx) liveExecutorCount() int {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.liveExecutors
+}
+
+// currentTask returns the task currently assigned to the worker and
+// whether one is assigned at all, as a single atomic read so callers
+// can't race a concurrent setFree() the way a separate isFree()+tsk read
+// would.
+func (ctx *TaskCtx) currentTask() (task.Task, bool) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.free {
+		return nil, false
+	}
+	return ctx.tsk, true
+}
+
+// scale adjusts the number of running executors for the current task up
+// or down. Scaling up spawns additional taskletExecutor goroutines;
+// scaling down signals a subset to drain their current tasklet and exit
+// via drainCh, a path distinct from the error-abort path so a drained
+// executor doesn't fail the task. Once the task has stopped accepting
+// executors (it's finishing up or already gone), scale is a no-op rather
+// than racing reduceTasklets or acting on a stale tsk.
+func (ctx *TaskCtx) scale(tsk task.Task, desired int) {
+	if desired < 1 {
+		// Never drain every executor: with tasklets still queued in
+		// todoTasklets, zero executors left to read them would wedge
+		// assignTasklets forever on an unconsumed send.
+		desired = 1
+	}
+	current := ctx.liveExecutorCount()
+	if current == 0 {
+		// Task already finished (or never started); nothing to scale.
+		return
+	}
+	if desired > current {
+		for i := current; i < desired; i++ {
+			ctx.mutex.Lock()
+			eid := ctx.executorIdSeq
+			ctx.executorIdSeq++
+			ctx.mutex.Unlock()
+			if !spawnExecutor(ctx, tsk, eid) {
+				// Task stopped accepting executors mid-loop; stop here.
+				break
+			}
+		}
+	} else if desired < current {
+		for i := desired; i < current; i++ {
+			go func() {
+				select {
+				case ctx.drainCh <- struct{}{}:
+				case <-ctx.allDone:
+					// Task finished before this token could be taken;
+					// drop it instead of leaking the goroutine forever.
+				}
+			}()
+		}
+	}
+}
+
+func (ctx *TaskCtx) appendFailedTasklet(taskletId string, attempts int, err error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.failed = append(ctx.failed, task.TaskletFailure{
+		TaskletId: taskletId,
+		Attempts:  attempts,
+		Err:       err.Error(),
+	})
+}
+
+func (ctx *TaskCtx) snapshotFailedTasklets() []task.TaskletFailure {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	failed := make([]task.TaskletFailure, len(ctx.failed))
+	copy(failed, ctx.failed)
+	return failed
+}
+
+func (ctx *TaskCtx) recordTaskletMetrics(taskletId string, m *task.TaskletMetrics) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.metrics[taskletId] = m
+}
+
+func (ctx *TaskCtx) snapshotMetrics() map[string]*task.TaskletMetrics {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	metrics := make(map[string]*task.TaskletMetrics, len(ctx.metrics))
+	for tid, m := range ctx.metrics {
+		metrics[tid] = m
+	}
+	return metrics
 }
 
 func (ctx *TaskCtx) kickoff() {
@@ -61,14 +203,22 @@ func (ctx *TaskCtx) finish() {
 
 func (ctx *TaskCtx) init() {
 	taskletCnt := ctx.tsk.GetTaskletCnt()
-	log.Info("Task %q tasklet count %d", ctx.tsk.GetTaskId(), taskletCnt)
+	ctx.logger = log.WithFields("task_id", ctx.tsk.GetTaskId())
+	ctx.logger.Info("Task tasklet count %d", taskletCnt)
 	ctx.todoTasklets = make(chan task.Tasklet, BUF_TASKLET_CNT)
 	ctx.doneTasklets = make(chan task.Tasklet, taskletCnt)
 	ctx.taskletCtxList = make([]task.TaskletCtx, 0)
+	ctx.drainCh = make(chan struct{})
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
 	ctx.err = nil
 	ctx.total = taskletCnt
+	ctx.metrics = make(map[string]*task.TaskletMetrics, taskletCnt)
+	ctx.failed = nil
+	ctx.liveExecutors = 0
+	ctx.accepting = true
+	ctx.allDone = make(chan struct{})
+	ctx.executorIdSeq = 0
 }
 
 func (ctx *TaskCtx) aborted() bool {
@@ -87,7 +237,7 @@ func (ctx *TaskCtx) setErr(err error) {
 	ctx.err = err
 }
 
-func (ctx *TaskCtx) checkAndUnsetFree(tsk task.Task) error {
+func (ctx *TaskCtx) checkAndUnsetFree(tsk task.Task, retention time.Duration, failurePolicy task.FailurePolicy) error {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
 	if !ctx.free {
@@ -95,9 +245,17 @@ func (ctx *TaskCtx) checkAndUnsetFree(tsk task.Task) error {
 	}
 	ctx.free = false
 	ctx.tsk = tsk
+	ctx.retention = retention
+	ctx.failurePolicy = failurePolicy
 	return nil
 }
 
+func (ctx *TaskCtx) isFree() bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.free
+}
+
 func (ctx *TaskCtx) setFree() {
 	log.Info("Set worker free")
 	ctx.mutex.Lock()
@@ -129,40 +287,59 @@ func (ctx *TaskCtx) getTaskStatus() *task.TaskStatus {
 	}
 }
 
-func getExecutorCnt() int {
-	return RUNNING_EXECUTOR_CNT
+func getExecutorCnt(tsk task.Task) int {
+	suggested := tsk.SuggestedParallelism()
+	if suggested <= 0 {
+		suggested = *maxExecutors
+	}
+	return clamp(suggested, *minExecutors, *maxExecutors)
 }
 
-func prepareExecutors(ctx *TaskCtx, tsk task.Task) {
-	cnt := getExecutorCnt()
+func prepareExecutors(ctx *TaskCtx, tsk task.Task, cnt int) {
 	for i := 0; i < cnt; i++ {
-		c := tsk.NewTaskletCtx()
-		ctx.wgFinish.Add(1)
-		go taskletExecutor(i, ctx, c)
-		if c != nil {
-			ctx.taskletCtxList = append(ctx.taskletCtxList, c)
-		}
+		spawnExecutor(ctx, tsk, i)
 	}
+	ctx.mutex.Lock()
+	ctx.executorIdSeq = cnt
+	ctx.mutex.Unlock()
+}
+
+// spawnExecutor starts one taskletExecutor goroutine, unless the task has
+// already stopped accepting executors. Reports whether it actually
+// started one.
+func spawnExecutor(ctx *TaskCtx, tsk task.Task, eid int) bool {
+	if !ctx.registerExecutor() {
+		return false
+	}
+	c := tsk.NewTaskletCtx()
+	go taskletExecutor(eid, ctx, c)
+	if c != nil {
+		ctx.mutex.Lock()
+		ctx.taskletCtxList = append(ctx.taskletCtxList, c)
+		ctx.mutex.Unlock()
+	}
+	return true
 }
 
 func releaseExecutors(ctx *TaskCtx) {
-	log.Info("Release all executors' ctx")
+	ctx.logger.Info("Release all executors' ctx")
 	for _, c := range ctx.taskletCtxList {
 		c.Close()
 	}
 }
 
 func waitForTaskDone(ctx *TaskCtx) {
-	log.Info("Wait for task %q done", ctx.tsk.GetTaskId())
-	tskctx.wgFinish.Wait()
+	ctx.logger.Info("Wait for task done")
+	<-ctx.allDone
 }
 
 func handleTaskReq(tsk task.Task) {
 	log.Info("Dealing with task %q", tsk.GetTaskId())
 	tskctx.kickoff()
-	if err := tsk.Init(RUNNING_EXECUTOR_CNT); err == nil {
+	cnt := getExecutorCnt(tsk)
+	if err := tsk.Init(cnt); err == nil {
 		tskctx.init()
-		prepareExecutors(tskctx, tsk)
+		prepareExecutors(tskctx, tsk, cnt)
 		assignTasklets(tskctx, tsk)
 		waitForTaskDone(tskctx)
 		releaseExecutors(tskctx)
@@ -177,16 +354,17 @@ func handleTaskReq(tsk task.Task) {
 	}
 	tskctx.finish()
 	report := generateTaskReport(tskctx)
+	results.put(report, tskctx.retention)
 	tskctx.setFree()
 	go sendTaskReport(report)
 }
 
 func assignTasklets(ctx *TaskCtx, tsk task.Task) {
-	log.Info("Assign tasklets")
+	ctx.logger.Info("Assign tasklets")
 	i := 0
 	for {
 		if ctx.aborted() {
-			log.Info("Abort assign tasklets")
+			ctx.logger.Info("Abort assign tasklets")
 			break
 		}
 		taskletid := fmt.Sprintf("%s-%d", tsk.GetTaskId(), i)
@@ -195,47 +373,171 @@ func assignTasklets(ctx *TaskCtx, tsk task.Task) {
 			close(ctx.todoTasklets)
 			break
 		}
-		log.Info("Put tasklet %q to todo list", tasklet.GetTaskletId())
+		ctx.logger.Info("Put tasklet %q to todo list", tasklet.GetTaskletId())
 		ctx.todoTasklets <- tasklet
 		i++
 	}
-	log.Info("Assign tasklets finished")
+	ctx.logger.Info("Assign tasklets finished")
 }
 
 func taskletExecutor(eid int, ctx *TaskCtx, c task.TaskletCtx) {
 	var err error
-	defer ctx.wgFinish.Done()
+	defer ctx.deregisterExecutor()
+	logger := ctx.logger.WithFields("executor_id", eid)
+	limits := ctx.tsk.GetResourceLimits()
+	cgSeq := 0
 	for {
 		if ctx.aborted() {
-			log.Info("Error set in taskctx, abort executor #%d", eid)
+			logger.Info("Error set in taskctx, abort executor")
 			break
 		}
-		log.Info("Executor #%d, retrieve todo tasklet...", eid)
-		tasklet, ok := <-ctx.todoTasklets
+		logger.Info("Retrieve todo tasklet...")
+		var tasklet task.Tasklet
+		var ok bool
+		select {
+		case <-ctx.drainCh:
+			logger.Info("Drain signal received, exit executor")
+			return
+		case tasklet, ok = <-ctx.todoTasklets:
+		}
 		if !ok {
-			log.Info("Todo tasklets drained, exit executor #%d", eid)
+			logger.Info("Todo tasklets drained, exit executor")
 			break
 		}
-		log.Info("Executor #%d execute tasklet %q", eid, tasklet.GetTaskletId())
+		taskletLogger := logger.WithFields("tasklet_id", tasklet.GetTaskletId())
+		taskletLogger.Info("Execute tasklet")
+		var metrics *task.TaskletMetrics
+		attempts := 0
 		for i := 0; i < TASKLET_MAX_RETRY; i++ {
-			if err = tasklet.Execute(c); err == nil {
+			attempts++
+			// A fresh cgroup per attempt, not one shared for the executor's
+			// whole lifetime: memory.peak/cpu.stat are cumulative since the
+			// cgroup's creation, so reusing one cgroup across tasklets would
+			// make every attempt's metrics (and the CPU budget check) include
+			// every prior attempt's usage too.
+			cg, cgErr := newTaskletCgroup(CGROUP_PARENT_PATH, eid, cgSeq, limits)
+			cgSeq++
+			if cgErr != nil {
+				logger.Error("Fail to set up cgroup, limits won't be enforced, %v", cgErr)
+			}
+			err, metrics = executeTaskletWithLimits(tasklet, c, cg, limits)
+			if cg != nil {
+				cg.close()
+			}
+			if err == nil {
 				break
 			}
-			log.Info("Retry execute tasklet %q", tasklet.GetTaskletId())
+			if metrics.TimedOut || metrics.CPUTimeExceeded {
+				// Deadline exceeded or CPU budget tripped: terminal, don't
+				// burn further retries. Both kills only reap child
+				// processes via c.Kill(), not the in-process
+				// tasklet.Execute goroutine still unwinding in the
+				// background, so retrying a CPU-budget kill would also
+				// pile up an overlapping goroutine on top of one that's
+				// already over budget.
+				break
+			}
+			taskletLogger.Info("Retry execute tasklet")
 		}
-		log.Info("Executor #%d execute tasklet %q done", eid, tasklet.GetTaskletId())
+		ctx.recordTaskletMetrics(tasklet.GetTaskletId(), metrics)
+		taskletLogger.Info("Execute tasklet done")
 		if err != nil {
-			log.Info("Fail on tasklet %q, err %v", tasklet.GetTaskletId(), err)
+			if ctx.failurePolicy == task.FailurePolicyContinue {
+				taskletLogger.Info("Tasklet failed under continue policy, reporting to master and moving on, err %v", err)
+				ctx.appendFailedTasklet(tasklet.GetTaskletId(), attempts, err)
+				reportTaskletFailed(ctx.tsk.GetTaskId(), tasklet.GetTaskletId(), attempts, err)
+				continue
+			}
+			taskletLogger.Info("Fail on tasklet, err %v", err)
 			tskctx.setErr(err)
 			break
 		}
 		ctx.appendDoneTasklet(tasklet)
 	}
-	log.Info("Executor #%d, exit", eid)
+	logger.Info("Executor exit")
+}
+
+// watchCPUBudget polls cg's total CPU usage and signals on exceeded once
+// it crosses cg.cpuBudgetUsec, since cgroup v2 has no way to enforce a
+// cumulative CPU budget directly (cpu.max only caps a recurring rate).
+func watchCPUBudget(ctx context.Context, cg *taskletCgroup, exceeded chan<- struct{}) {
+	ticker := time.NewTicker(CPU_BUDGET_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			over, err := cg.cpuBudgetExceeded()
+			if err != nil {
+				continue
+			}
+			if over {
+				exceeded <- struct{}{}
+				return
+			}
+		}
+	}
+}
+
+// executeTaskletWithLimits runs one attempt of tasklet.Execute under the
+// deadline from limits, handed to the TaskletCtx so the tasklet
+// implementation can observe cancellation. On deadline, the executor kills
+// any child processes via c.Kill() and fails the attempt without retrying.
+// Afterwards it reads back cgroup accounting (when cg is non-nil) into the
+// returned metrics.
+func executeTaskletWithLimits(tasklet task.Tasklet, c task.TaskletCtx, cg *taskletCgroup, limits task.ResourceLimits) (error, *task.TaskletMetrics) {
+	metrics := new(task.TaskletMetrics)
+	deadline := context.Background()
+	cancel := func() {}
+	// Timeout() is 0 when a task sets no resource limits; a zero timeout
+	// would make context.WithTimeout's deadline already-expired, so leave
+	// the context undeadlined in that case instead of killing every
+	// tasklet on its first scheduling.
+	if timeout := limits.Timeout(); timeout > 0 {
+		deadline, cancel = context.WithTimeout(deadline, timeout)
+	}
+	defer cancel()
+	c.SetContext(deadline)
+	if cg != nil {
+		if err := cg.addProcess(os.Getpid()); err != nil {
+			log.Error("Fail to move executor into cgroup, limits won't be enforced for this tasklet, %v", err)
+		}
+	}
+	cpuExceeded := make(chan struct{}, 1)
+	if cg != nil && cg.cpuBudgetUsec > 0 {
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+		go watchCPUBudget(watchCtx, cg, cpuExceeded)
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- tasklet.Execute(c) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-deadline.Done():
+		c.Kill()
+		metrics.TimedOut = true
+		err = fmt.Errorf("Tasklet %q timed out after %v", tasklet.GetTaskletId(), limits.Timeout())
+	case <-cpuExceeded:
+		c.Kill()
+		metrics.CPUTimeExceeded = true
+		err = fmt.Errorf("Tasklet %q exceeded CPU time budget of %dms", tasklet.GetTaskletId(), limits.CPUTimeMs)
+	}
+	metrics.WallTimeMs = time.Since(start).Milliseconds()
+	if cg != nil {
+		if cgm, cgErr := cg.readMetrics(); cgErr == nil {
+			metrics.PeakRSSBytes = cgm.PeakRSSBytes
+			metrics.CPUTimeMs = cgm.CPUTimeMs
+			metrics.OOMKilled = cgm.OOMKilled
+		}
+	}
+	return err, metrics
 }
 
 func reduceTasklets(tsk task.Task, ctx *TaskCtx) {
-	log.Info("Reduce tasklets for task %q", tsk.GetTaskId())
+	ctx.logger.Info("Reduce tasklets")
 	close(ctx.doneTasklets)
 	tasklets := make([]task.Tasklet, 0, len(ctx.doneTasklets))
 	for {
@@ -245,7 +547,7 @@ func reduceTasklets(tsk task.Task, ctx *TaskCtx) {
 		}
 		tasklets = append(tasklets, tasklet)
 	}
-	tsk.ReduceTasklets(tasklets)
+	tsk.ReduceTasklets(tasklets, ctx.snapshotFailedTasklets())
 }
 
 func generateTaskReport(ctx *TaskCtx) *task.TaskReport {
@@ -255,25 +557,44 @@ func generateTaskReport(ctx *TaskCtx) *task.TaskReport {
 	if err := tsk.GetError(); err != nil {
 		errMsg = err.Error()
 	}
+	if status != nil {
+		status.TaskletMetrics = ctx.snapshotMetrics()
+	}
 	return &task.TaskReport{
-		Err:     errMsg,
-		Tid:     tsk.GetTaskId(),
-		Kind:    tsk.GetKind(),
-		StartTs: ctx.startTs,
-		EndTs:   ctx.endTs,
-		Status:  status,
-		Output:  tsk.GetOutput(),
+		Err:            errMsg,
+		Tid:            tsk.GetTaskId(),
+		Kind:           tsk.GetKind(),
+		StartTs:        ctx.startTs,
+		EndTs:          ctx.endTs,
+		FailedTasklets: ctx.snapshotFailedTasklets(),
+		Status:         status,
+		Output:         tsk.GetOutput(),
 	}
 }
 
 func sendTaskReport(report *task.TaskReport) {
 	log.Info("Send out task report for %q", report.Tid)
-	u := workerSelf.makeMasterUrl(uri.MasterWorkerTaskReportUri)
-	if _, err := util.HttpPostData(u, report); err == nil {
-		log.Info("Send out task report for %q done", report.Tid)
-	} else {
-		// TODO need retry on error
-		log.Error("Send out task report for %q failed, %v", report.Tid, err)
+	if err := postTaskReport(report); err != nil {
+		log.Error("Send out task report for %q failed, spooling for retry, %v", report.Tid, err)
+		spool.enqueue(report)
+		return
+	}
+	log.Info("Send out task report for %q done", report.Tid)
+}
+
+// reportTaskletFailed notifies the master of one failed tasklet under the
+// "continue" failure policy, so the master can track per-task retry counts
+// across workers and decide whether to reassign it.
+func reportTaskletFailed(taskId, taskletId string, attempts int, taskletErr error) {
+	u := workerSelf.makeMasterUrl(uri.MasterWorkerTaskletFailedUri)
+	msg := &TaskletFailedMsg{
+		TaskId:    taskId,
+		TaskletId: taskletId,
+		Attempts:  attempts,
+		Err:       taskletErr.Error(),
+	}
+	if _, err := util.HttpPostData(u, msg); err != nil {
+		log.Error("Fail to report tasklet %q failure for task %q, %v", taskletId, taskId, err)
 	}
 }
 
@@ -311,7 +632,7 @@ func taskRecepiant(tspec *task.TaskSpec) error {
 	if err != nil {
 		return err
 	}
-	if err := tskctx.checkAndUnsetFree(tsk); err != nil {
+	if err := tskctx.checkAndUnsetFree(tsk, tspec.Retention, tspec.FailurePolicy); err != nil {
 		return err
 	}
 	go handleTaskReq(tsk)